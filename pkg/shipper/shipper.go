@@ -3,13 +3,21 @@
 package shipper
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"io"
 	"io/ioutil"
 	"math"
 	"os"
 	"path"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
@@ -61,15 +69,86 @@ func newMetrics(r prometheus.Registerer) *metrics {
 	return &m
 }
 
+// Leaser acquires and releases a lock that prevents more than one shipper from
+// uploading compacted blocks for the same external labels at once, e.g. when
+// two sidecars are pointed at the same HA Prometheus pair.
+type Leaser interface {
+	// Lock acquires the lease for uploading compacted blocks. It returns false
+	// if the lease is currently held by someone else.
+	Lock(ctx context.Context) (bool, error)
+	// Unlock releases a previously acquired lease.
+	Unlock(ctx context.Context) error
+}
+
+// BlockSnapshotter is satisfied by a TSDB that can atomically hardlink the full,
+// valid set of files for one of its blocks into another directory, e.g. *tsdb.DB
+// or *tsdb.Block. Snapshot(dir) creates dir/<ULID>/... itself; it does not hardlink
+// flat into dir.
+type BlockSnapshotter interface {
+	Snapshot(dir string) error
+}
+
 // Shipper watches a directory for matching files and directories and uploads
 // them to a remote data store.
 type Shipper struct {
-	logger  log.Logger
-	dir     string
-	metrics *metrics
-	bucket  objstore.Bucket
-	labels  func() labels.Labels
-	source  block.SourceType
+	logger            log.Logger
+	dir               string
+	metrics           *metrics
+	bucket            objstore.Bucket
+	labels            func() labels.Labels
+	source            block.SourceType
+	uploadCompacted   bool
+	leaser            Leaser
+	snapshotter       BlockSnapshotter
+	uploadConcurrency int
+}
+
+// defaultUploadConcurrency is the number of blocks uploaded at once when
+// WithUploadConcurrency is not set, i.e. strictly sequential.
+const defaultUploadConcurrency = 1
+
+// Option overrides behavior of the Shipper.
+type Option func(*Shipper)
+
+// WithUploadConcurrency bounds how many blocks the shipper uploads to the bucket at
+// once during a single Sync. It is useful for catching up quickly after the shipper
+// was offline for a while and many blocks are pending. n is clamped to at least 1: 0
+// would make the upload semaphore unbuffered and deadlock Sync forever, and a negative
+// n would panic when the semaphore channel is created.
+func WithUploadConcurrency(n int) Option {
+	if n < 1 {
+		n = 1
+	}
+	return func(s *Shipper) {
+		s.uploadConcurrency = n
+	}
+}
+
+// WithBlockSnapshotter configures a BlockSnapshotter (typically the TSDB itself) to
+// hardlink block files into the upload directory. When unset, the shipper falls back
+// to hardlinking the files it knows about by hand, which is only safe when dir is not
+// the data directory of an open TSDB.
+func WithBlockSnapshotter(snap BlockSnapshotter) Option {
+	return func(s *Shipper) {
+		s.snapshotter = snap
+	}
+}
+
+// WithUploadCompacted enables uploading of blocks with a compaction level higher than 1,
+// i.e. blocks that were produced by TSDB's own compaction rather than directly written by
+// the scrape loop. A Leaser must be configured via WithLeaser to avoid two sidecars against
+// the same HA Prometheus pair uploading the same compacted block concurrently.
+func WithUploadCompacted(enable bool) Option {
+	return func(s *Shipper) {
+		s.uploadCompacted = enable
+	}
+}
+
+// WithLeaser configures the Leaser used to guard uploads of compacted blocks.
+func WithLeaser(l Leaser) Option {
+	return func(s *Shipper) {
+		s.leaser = l
+	}
 }
 
 // New creates a new shipper that detects new TSDB blocks in dir and uploads them
@@ -81,6 +160,7 @@ func New(
 	bucket objstore.Bucket,
 	lbls func() labels.Labels,
 	source block.SourceType,
+	opts ...Option,
 ) *Shipper {
 	if logger == nil {
 		logger = log.NewNopLogger()
@@ -88,14 +168,19 @@ func New(
 	if lbls == nil {
 		lbls = func() labels.Labels { return nil }
 	}
-	return &Shipper{
-		logger:  logger,
-		dir:     dir,
-		bucket:  bucket,
-		labels:  lbls,
-		metrics: newMetrics(r),
-		source:  source,
+	s := &Shipper{
+		logger:            logger,
+		dir:               dir,
+		bucket:            bucket,
+		labels:            lbls,
+		metrics:           newMetrics(r),
+		source:            source,
+		uploadConcurrency: defaultUploadConcurrency,
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
+	return s
 }
 
 // Timestamps returns the minimum timestamp for which data is available and the highest timestamp
@@ -138,6 +223,8 @@ func (s *Shipper) Timestamps() (minTime, maxSyncTime int64, err error) {
 // to the object bucket once.
 // It is not concurrency-safe.
 func (s *Shipper) Sync(ctx context.Context) {
+	s.metrics.dirSyncs.Inc()
+
 	meta, err := ReadMetaFile(s.dir)
 	if err != nil {
 		// If we encounter any error, proceed with an empty meta file and overwrite it later.
@@ -153,72 +240,238 @@ func (s *Shipper) Sync(ctx context.Context) {
 	for _, id := range meta.Uploaded {
 		hasUploaded[id] = struct{}{}
 	}
+	// Build a map of blocks Clean deliberately removed from the bucket. Their local
+	// directory may still exist (e.g. bucket retention shorter than local TSDB
+	// retention), but we must not resurrect them by uploading again.
+	isCleaned := make(map[ulid.ULID]struct{}, len(meta.Cleaned))
+	for _, id := range meta.Cleaned {
+		isCleaned[id] = struct{}{}
+	}
 	// Reset the uploaded slice so we can rebuild it only with blocks that still exist locally.
 	meta.Uploaded = nil
 
 	// TODO(bplotka): If there are no blocks in the system check for WAL dir to ensure we have actually
 	// access to real TSDB dir (!).
-	if err = s.iterBlockMetas(func(m *block.Meta) error {
+	var metas []*block.Meta
+	if err := s.iterBlockMetas(func(m *block.Meta) error {
+		metas = append(metas, m)
+		return nil
+	}); err != nil {
+		s.metrics.dirSyncFailures.Inc()
+		level.Error(s.logger).Log("msg", "iter block metas failed", "err", err)
+		return
+	}
+
+	// Acquire the lease, if any, once for this whole pass rather than per block: leasing
+	// around each compacted block individually would leave a gap between blocks where
+	// another sidecar could grab the lease and upload a different, possibly overlapping,
+	// compacted block for the same external labels.
+	leaseHeld, acquired, err := s.lockCompacted(ctx, metas, hasUploaded, isCleaned)
+	if err != nil {
+		level.Error(s.logger).Log("msg", "acquire upload lease failed", "err", err)
+		return
+	}
+	if !leaseHeld {
+		level.Debug(s.logger).Log("msg", "skipping compacted blocks this sync, lease held by another shipper")
+	}
+	// Only release a lease we actually took: lockCompacted also returns leaseHeld=true
+	// when no lease was needed at all, and unlocking then would release a lease another
+	// shipper legitimately holds.
+	if acquired {
+		defer s.unlockCompacted(ctx)
+	}
+
+	var (
+		wg         sync.WaitGroup
+		uploadedMu sync.Mutex
+		sem        = make(chan struct{}, s.uploadConcurrency)
+	)
+	for _, m := range metas {
+		m := m
+		if _, ok := isCleaned[m.ULID]; ok {
+			continue
+		}
 		// Do not sync a block if we already uploaded it. If it is no longer found in the bucket,
 		// it was generally removed by the compaction process.
-		if _, ok := hasUploaded[m.ULID]; !ok {
-			if err := s.sync(ctx, m); err != nil {
+		if _, ok := hasUploaded[m.ULID]; ok {
+			uploadedMu.Lock()
+			meta.Uploaded = append(meta.Uploaded, m.ULID)
+			uploadedMu.Unlock()
+			continue
+		}
+		if m.Compaction.Level > 1 && s.uploadCompacted && s.leaser != nil && !leaseHeld {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			// Each block uploads into its own updir keyed by ULID, so concurrent
+			// syncs never contend on the same upload directory.
+			if err := s.sync(ctx, m, true); err != nil {
 				level.Error(s.logger).Log("msg", "shipping failed", "block", m.ULID, "err", err)
 				// No error returned, just log line. This is because we want other blocks to be uploaded even
 				// though this one failed. It will be retried on second Sync iteration.
-				return nil
+				return
 			}
-		}
-		meta.Uploaded = append(meta.Uploaded, m.ULID)
-		return nil
-	}); err != nil {
-		level.Error(s.logger).Log("msg", "iter block metas failed", "err", err)
-		return
+			uploadedMu.Lock()
+			meta.Uploaded = append(meta.Uploaded, m.ULID)
+			uploadedMu.Unlock()
+		}()
 	}
+	wg.Wait()
+
+	// Sort so the meta file has a stable, deterministic ULID ordering regardless of
+	// which upload finished first.
+	sort.Slice(meta.Uploaded, func(i, j int) bool {
+		return meta.Uploaded[i].Compare(meta.Uploaded[j]) < 0
+	})
+
 	if err := WriteMetaFile(s.logger, s.dir, meta); err != nil {
 		level.Warn(s.logger).Log("msg", "updating meta file failed", "err", err)
 	}
 }
 
-func (s *Shipper) sync(ctx context.Context, meta *block.Meta) (err error) {
+// lockCompacted acquires the Leaser once for an entire Sync pass, rather than
+// per compacted block, so two sidecars against the same external labels can't interleave
+// uploads of different, possibly overlapping, compacted blocks. proceed reports whether
+// compacted blocks may be synced this pass; acquired reports whether Lock was actually
+// called and succeeded, i.e. whether the caller is responsible for calling
+// unlockCompacted. acquired is false whenever no lease was needed in the first place
+// (uploading compacted blocks is disabled, no Leaser is configured, or none of metas is
+// an unsynced compacted block) -- the caller must not unlock in that case.
+func (s *Shipper) lockCompacted(ctx context.Context, metas []*block.Meta, hasUploaded, isCleaned map[ulid.ULID]struct{}) (proceed, acquired bool, err error) {
+	if !s.uploadCompacted || s.leaser == nil {
+		return true, false, nil
+	}
+	pending := false
+	for _, m := range metas {
+		if _, ok := isCleaned[m.ULID]; ok {
+			continue
+		}
+		if _, ok := hasUploaded[m.ULID]; ok {
+			continue
+		}
+		if m.Compaction.Level > 1 {
+			pending = true
+			break
+		}
+	}
+	if !pending {
+		return true, false, nil
+	}
+	held, err := s.leaser.Lock(ctx)
+	if err != nil {
+		return false, false, err
+	}
+	return held, held, nil
+}
+
+// unlockCompacted releases a lease acquired by lockCompacted.
+func (s *Shipper) unlockCompacted(ctx context.Context) {
+	if err := s.leaser.Unlock(ctx); err != nil {
+		level.Error(s.logger).Log("msg", "failed to release upload lease", "err", err)
+	}
+}
+
+// sync uploads meta's block if it isn't already in the bucket. With verify set, a present
+// meta.json only counts as "already in the bucket" if the block's upload manifest also
+// validates; otherwise the block is uploaded again. Without verify, bucket.Exists alone
+// decides. Sync only calls sync for blocks the local meta file does not yet list as
+// uploaded, so blocks it has already recorded are not re-hashed on every pass.
+func (s *Shipper) sync(ctx context.Context, meta *block.Meta, verify bool) (err error) {
 	dir := filepath.Join(s.dir, meta.ULID.String())
 
-	// We only ship of the first compacted block level.
-	// TODO(bplotka): https://github.com/improbable-eng/thanos/issues/206
-	if meta.Compaction.Level > 1 {
+	if meta.Compaction.Level > 1 && !s.uploadCompacted {
 		return nil
 	}
+	// The caller (Sync via lockCompacted, or Verify) is responsible for holding the
+	// Leaser for the whole pass before calling sync on a compacted block.
 
-	// Check against bucket if the meta file for this block exists.
+	// Check against bucket if the meta file for this block exists. A present meta.json
+	// alone does not prove the upload completed, e.g. a sidecar crash between uploading
+	// meta.json and the remaining block files would also leave it behind, so with verify
+	// set the upload manifest is validated before trusting it.
 	ok, err := s.bucket.Exists(ctx, path.Join(meta.ULID.String(), block.MetaFilename))
 	if err != nil {
 		return errors.Wrap(err, "check exists")
 	}
 	if ok {
-		return nil
+		if !verify {
+			return nil
+		}
+		valid, err := s.validateUploadManifest(ctx, meta.ULID)
+		if err != nil {
+			level.Warn(s.logger).Log("msg", "validating upload manifest failed, re-uploading", "block", meta.ULID, "err", err)
+		} else if valid {
+			return nil
+		} else {
+			level.Warn(s.logger).Log("msg", "upload manifest invalid, re-uploading block", "block", meta.ULID)
+		}
 	}
 
+	// Past this point we are committed to an upload attempt, so its outcome counts
+	// towards the uploads/uploadFailures metrics.
+	defer func() {
+		if err != nil {
+			s.metrics.uploadFailures.Inc()
+			return
+		}
+		s.metrics.uploads.Inc()
+	}()
+
 	level.Info(s.logger).Log("msg", "upload new block", "id", meta.ULID)
 
 	// We hard-link the files into a temporary upload directory so we are not affected
 	// by other operations happening against the TSDB directory.
 	updir := filepath.Join(s.dir, "thanos", "upload", meta.ULID.String())
+	uploadRoot := filepath.Dir(updir)
 
 	// Remove updir just in case.
 	if err := os.RemoveAll(updir); err != nil {
 		return errors.Wrap(err, "clean upload directory")
 	}
-	if err := os.MkdirAll(updir, 0777); err != nil {
-		return errors.Wrap(err, "create upload dir")
-	}
 	defer func() {
 		if err := os.RemoveAll(updir); err != nil {
 			level.Error(s.logger).Log("msg", "failed to clean upload directory", "err", err)
 		}
 	}()
 
-	if err := hardlinkBlock(dir, updir); err != nil {
-		return errors.Wrap(err, "hard link block")
+	if err := os.MkdirAll(uploadRoot, 0777); err != nil {
+		return errors.Wrap(err, "create upload dir")
+	}
+
+	if s.snapshotter != nil {
+		// A BlockSnapshotter may be a whole-DB implementer (e.g. *tsdb.DB) that
+		// hardlinks every currently-live block into the given directory, not just this
+		// one, so we point Snapshot at a block-private scratch directory and move out
+		// only this block's own <ULID> subtree, discarding whatever else it wrote. That
+		// also keeps concurrent syncs of different blocks from racing on one shared
+		// directory.
+		tmpRoot, err := ioutil.TempDir(uploadRoot, "snapshot-"+meta.ULID.String()+"-")
+		if err != nil {
+			return errors.Wrap(err, "create snapshot scratch dir")
+		}
+		defer func() {
+			if err := os.RemoveAll(tmpRoot); err != nil {
+				level.Error(s.logger).Log("msg", "failed to clean snapshot scratch directory", "err", err)
+			}
+		}()
+		if err := s.snapshotter.Snapshot(tmpRoot); err != nil {
+			return errors.Wrap(err, "snapshot block")
+		}
+		if err := os.Rename(filepath.Join(tmpRoot, meta.ULID.String()), updir); err != nil {
+			return errors.Wrap(err, "move snapshot into upload dir")
+		}
+	} else {
+		if err := os.MkdirAll(updir, 0777); err != nil {
+			return errors.Wrap(err, "create upload dir")
+		}
+		if err := hardlinkBlock(dir, updir); err != nil {
+			return errors.Wrap(err, "hard link block")
+		}
 	}
 	// Attach current labels and write a new meta file with Thanos extensions.
 	if lset := s.labels(); lset != nil {
@@ -228,7 +481,294 @@ func (s *Shipper) sync(ctx context.Context, meta *block.Meta) (err error) {
 	if err := block.WriteMetaFile(s.logger, updir, meta); err != nil {
 		return errors.Wrap(err, "write meta file")
 	}
-	return block.Upload(ctx, s.logger, s.bucket, updir)
+	if err := block.Upload(ctx, s.logger, s.bucket, updir); err != nil {
+		return errors.Wrap(err, "upload block")
+	}
+	return s.uploadManifest(ctx, meta.ULID, updir)
+}
+
+// UploadManifestFilename is the object placed alongside each uploaded block that records
+// a SHA256 checksum per uploaded file. Its presence and contents let a later Sync tell a
+// complete upload apart from one truncated by a sidecar crash, which bucket.Exists alone
+// cannot do.
+const UploadManifestFilename = "thanos.upload.json"
+
+// uploadManifest is the content of UploadManifestFilename, keyed by each file's path
+// relative to the block directory.
+type uploadManifest struct {
+	Checksums map[string]string `json:"checksums"`
+}
+
+// buildUploadManifest computes a SHA256 checksum for every regular file under dir.
+func buildUploadManifest(dir string) (*uploadManifest, error) {
+	m := &uploadManifest{Checksums: map[string]string{}}
+
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return errors.Wrapf(err, "open %s", rel)
+		}
+		defer f.Close()
+
+		h := sha256.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return errors.Wrapf(err, "checksum %s", rel)
+		}
+		m.Checksums[rel] = hex.EncodeToString(h.Sum(nil))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// uploadManifest builds and uploads the manifest of checksums for the block files in
+// updir to <ULID>/thanos.upload.json.
+func (s *Shipper) uploadManifest(ctx context.Context, id ulid.ULID, updir string) error {
+	m, err := buildUploadManifest(updir)
+	if err != nil {
+		return errors.Wrap(err, "build upload manifest")
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return errors.Wrap(err, "encode upload manifest")
+	}
+	return s.bucket.Upload(ctx, path.Join(id.String(), UploadManifestFilename), bytes.NewReader(b))
+}
+
+// validateUploadManifest fetches the upload manifest for block id from the bucket and
+// verifies that each file it lists is still present with a matching checksum.
+func (s *Shipper) validateUploadManifest(ctx context.Context, id ulid.ULID) (bool, error) {
+	rc, err := s.bucket.Get(ctx, path.Join(id.String(), UploadManifestFilename))
+	if err != nil {
+		if s.bucket.IsObjNotFoundErr(err) {
+			return false, nil
+		}
+		return false, errors.Wrap(err, "get upload manifest")
+	}
+	defer runutil.CloseWithLogOnErr(s.logger, rc, "close upload manifest reader")
+
+	var m uploadManifest
+	if err := json.NewDecoder(rc).Decode(&m); err != nil {
+		return false, errors.Wrap(err, "decode upload manifest")
+	}
+
+	for rel, sum := range m.Checksums {
+		frc, err := s.bucket.Get(ctx, path.Join(id.String(), rel))
+		if err != nil {
+			if s.bucket.IsObjNotFoundErr(err) {
+				return false, nil
+			}
+			return false, errors.Wrapf(err, "get %s", rel)
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, frc)
+		runutil.CloseWithLogOnErr(s.logger, frc, "close block file reader")
+		if err != nil {
+			return false, errors.Wrapf(err, "checksum %s", rel)
+		}
+		if hex.EncodeToString(h.Sum(nil)) != sum {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Verify walks every ULID in the local meta file's Uploaded list and re-uploads any
+// whose bucket state fails upload manifest validation; sync already does that check and
+// re-uploads on a failed or missing manifest, so Verify just drives it per block. A
+// block whose local directory is already gone cannot be re-uploaded, so Verify only logs
+// it instead of silently skipping it.
+func (s *Shipper) Verify(ctx context.Context) error {
+	meta, err := ReadMetaFile(s.dir)
+	if err != nil {
+		return errors.Wrap(err, "read shipper meta file")
+	}
+
+	localMetas := map[ulid.ULID]*block.Meta{}
+	if err := s.iterBlockMetas(func(m *block.Meta) error {
+		localMetas[m.ULID] = m
+		return nil
+	}); err != nil {
+		return errors.Wrap(err, "iter block metas")
+	}
+
+	// Hold the lease, if any, for the whole verification pass rather than per block; see
+	// lockCompacted.
+	leaseHeld := true
+	if s.uploadCompacted && s.leaser != nil {
+		pending := false
+		for _, id := range meta.Uploaded {
+			if m, ok := localMetas[id]; ok && m.Compaction.Level > 1 {
+				pending = true
+				break
+			}
+		}
+		if pending {
+			var err error
+			leaseHeld, err = s.leaser.Lock(ctx)
+			if err != nil {
+				return errors.Wrap(err, "acquire upload lease")
+			}
+			if leaseHeld {
+				defer s.unlockCompacted(ctx)
+			}
+		}
+	}
+
+	for _, id := range meta.Uploaded {
+		m, ok := localMetas[id]
+		if !ok {
+			level.Warn(s.logger).Log("msg", "cannot verify uploaded block, local copy no longer exists", "block", id)
+			continue
+		}
+		if m.Compaction.Level > 1 && s.uploadCompacted && s.leaser != nil && !leaseHeld {
+			level.Debug(s.logger).Log("msg", "skipping verification of compacted block, lease held by another shipper", "block", id)
+			continue
+		}
+		if err := s.sync(ctx, m, true); err != nil {
+			return errors.Wrapf(err, "verify block %s", id)
+		}
+	}
+	return nil
+}
+
+// Clean deletes blocks in the bucket that carry this shipper's external labels and are
+// either older than retention or have been rolled up into a higher-level compacted block that is also
+// present in the bucket. A retention of 0 disables age-based deletion. Afterwards, the
+// local meta file is pruned of any ULIDs that no longer exist in the bucket so the
+// deduplication map used by Sync stays bounded, and the deleted ULIDs are recorded as
+// Cleaned so Sync does not re-upload them while their local directory still lingers.
+func (s *Shipper) Clean(ctx context.Context, retention time.Duration) error {
+	bucketMetas, err := s.listUploadedMetas(ctx)
+	if err != nil {
+		return errors.Wrap(err, "list uploaded blocks")
+	}
+
+	// A block is superseded if it is listed as a compaction source of another block
+	// that is also present in the bucket.
+	superseded := map[ulid.ULID]struct{}{}
+	for _, m := range bucketMetas {
+		for _, src := range m.Compaction.Sources {
+			if _, ok := bucketMetas[src]; ok && src != m.ULID {
+				superseded[src] = struct{}{}
+			}
+		}
+	}
+
+	now := time.Now()
+	var deleted []ulid.ULID
+	for id, m := range bucketMetas {
+		_, rolledUp := superseded[id]
+		expired := retention > 0 && now.Sub(time.Unix(0, m.MaxTime*int64(time.Millisecond))) > retention
+		if !rolledUp && !expired {
+			continue
+		}
+		level.Info(s.logger).Log("msg", "deleting block from bucket", "block", id, "rolledUp", rolledUp, "expired", expired)
+		if err := block.Delete(ctx, s.logger, s.bucket, id); err != nil {
+			return errors.Wrapf(err, "delete block %s", id)
+		}
+		delete(bucketMetas, id)
+		deleted = append(deleted, id)
+	}
+	return s.pruneLocalMeta(bucketMetas, deleted)
+}
+
+// listUploadedMetas returns the Thanos meta file for every block in the bucket that
+// carries this shipper's external labels.
+func (s *Shipper) listUploadedMetas(ctx context.Context) (map[ulid.ULID]*block.Meta, error) {
+	lset := s.labels().Map()
+	metas := map[ulid.ULID]*block.Meta{}
+
+	err := s.bucket.Iter(ctx, "", func(name string) error {
+		id, ok := block.IsBlockDir(name)
+		if !ok {
+			return nil
+		}
+		rc, err := s.bucket.Get(ctx, path.Join(name, block.MetaFilename))
+		if err != nil {
+			if s.bucket.IsObjNotFoundErr(err) {
+				return nil
+			}
+			return errors.Wrapf(err, "get meta for block %s", id)
+		}
+		defer runutil.CloseWithLogOnErr(s.logger, rc, "close meta reader")
+
+		var m block.Meta
+		if err := json.NewDecoder(rc).Decode(&m); err != nil {
+			return errors.Wrapf(err, "decode meta for block %s", id)
+		}
+		if !reflect.DeepEqual(m.Thanos.Labels, lset) {
+			return nil
+		}
+		metas[id] = &m
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "iter bucket")
+	}
+	return metas, nil
+}
+
+// pruneLocalMeta drops ULIDs from the local meta file's Uploaded slice that no longer
+// have a corresponding block in the bucket, and records newlyDeleted in Cleaned so Sync
+// knows not to re-upload them just because their local directory still exists (e.g.
+// because bucket retention is shorter than local TSDB retention). A Cleaned entry is
+// itself dropped once its local block directory is also gone, keeping it bounded.
+func (s *Shipper) pruneLocalMeta(bucketMetas map[ulid.ULID]*block.Meta, newlyDeleted []ulid.ULID) error {
+	meta, err := ReadMetaFile(s.dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return errors.Wrap(err, "read shipper meta file")
+		}
+		meta = &Meta{Version: 1}
+	}
+
+	kept := meta.Uploaded[:0]
+	for _, id := range meta.Uploaded {
+		if _, ok := bucketMetas[id]; ok {
+			kept = append(kept, id)
+		}
+	}
+	meta.Uploaded = kept
+
+	localBlocks := map[ulid.ULID]struct{}{}
+	if err := s.iterBlockMetas(func(m *block.Meta) error {
+		localBlocks[m.ULID] = struct{}{}
+		return nil
+	}); err != nil {
+		return errors.Wrap(err, "iter block metas")
+	}
+
+	stillCleaned := map[ulid.ULID]struct{}{}
+	for _, id := range meta.Cleaned {
+		stillCleaned[id] = struct{}{}
+	}
+	for _, id := range newlyDeleted {
+		stillCleaned[id] = struct{}{}
+	}
+	meta.Cleaned = meta.Cleaned[:0]
+	for id := range stillCleaned {
+		if _, ok := localBlocks[id]; ok {
+			meta.Cleaned = append(meta.Cleaned, id)
+		}
+	}
+	sort.Slice(meta.Cleaned, func(i, j int) bool {
+		return meta.Cleaned[i].Compare(meta.Cleaned[j]) < 0
+	})
+
+	return WriteMetaFile(s.logger, s.dir, meta)
 }
 
 // iterBlockMetas calls f with the block meta for each block found in dir. It logs
@@ -265,6 +805,10 @@ func (s *Shipper) iterBlockMetas(f func(m *block.Meta) error) error {
 	return nil
 }
 
+// hardlinkBlock hardlinks the known set of block files from src into dst. It is only
+// used as a fallback for directories that are not backed by an open TSDB (see
+// BlockSnapshotter), since it has to enumerate block files by hand and can fall behind
+// if TSDB ever adds new ones.
 func hardlinkBlock(src, dst string) error {
 	chunkDir := filepath.Join(dst, block.ChunksDirname)
 
@@ -281,6 +825,13 @@ func hardlinkBlock(src, dst string) error {
 	}
 	files = append(files, block.MetaFilename, block.IndexFilename)
 
+	// Tombstones are optional; a block without deleted series may not have one.
+	if _, err := os.Stat(filepath.Join(src, block.TombstonesFilename)); err == nil {
+		files = append(files, block.TombstonesFilename)
+	} else if !os.IsNotExist(err) {
+		return errors.Wrap(err, "stat tombstones file")
+	}
+
 	for _, fn := range files {
 		if err := os.Link(filepath.Join(src, fn), filepath.Join(dst, fn)); err != nil {
 			return errors.Wrapf(err, "hard link file %s", fn)
@@ -293,6 +844,11 @@ func hardlinkBlock(src, dst string) error {
 type Meta struct {
 	Version  int         `json:"version"`
 	Uploaded []ulid.ULID `json:"uploaded"`
+	// Cleaned holds ULIDs of blocks Clean has deliberately removed from the bucket
+	// while their local directory still exists, so Sync does not mistake that local
+	// presence for a block that still needs uploading. An entry is dropped once its
+	// local block directory is gone too.
+	Cleaned []ulid.ULID `json:"cleaned,omitempty"`
 }
 
 // MetaFilename is the known JSON filename for meta information.
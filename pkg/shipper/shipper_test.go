@@ -0,0 +1,105 @@
+package shipper
+
+import (
+	"context"
+	"testing"
+
+	"github.com/improbable-eng/thanos/pkg/block"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/tsdb"
+)
+
+// fakeLeaser counts Lock/Unlock calls so tests can assert lockCompacted only takes the
+// lease when it actually needs to, and never releases a lease it never took.
+type fakeLeaser struct {
+	lockCalls, unlockCalls int
+	lockOK                 bool
+	lockErr                error
+}
+
+func (f *fakeLeaser) Lock(ctx context.Context) (bool, error) {
+	f.lockCalls++
+	return f.lockOK, f.lockErr
+}
+
+func (f *fakeLeaser) Unlock(ctx context.Context) error {
+	f.unlockCalls++
+	return nil
+}
+
+func compactedMeta(id ulid.ULID, level int) *block.Meta {
+	return &block.Meta{BlockMeta: tsdb.BlockMeta{ULID: id, Compaction: tsdb.BlockMetaCompaction{Level: level}}}
+}
+
+func TestShipper_lockCompacted_NoPendingCompactedBlock(t *testing.T) {
+	id := ulid.MustParse("01ARZ3NDEKTSV4RRFFQ69G5FAV")
+	leaser := &fakeLeaser{lockOK: true}
+	s := &Shipper{uploadCompacted: true, leaser: leaser}
+
+	proceed, acquired, err := s.lockCompacted(context.Background(), []*block.Meta{compactedMeta(id, 1)}, nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !proceed {
+		t.Fatal("expected proceed=true when nothing compacted is pending")
+	}
+	if acquired {
+		t.Fatal("expected acquired=false since Lock should never have been called")
+	}
+	if leaser.lockCalls != 0 {
+		t.Fatalf("expected Lock to never be called, got %d calls", leaser.lockCalls)
+	}
+}
+
+func TestShipper_lockCompacted_PendingCompactedBlock(t *testing.T) {
+	id := ulid.MustParse("01BTGNYV6HRNK8K8VKZASZCFPE")
+	leaser := &fakeLeaser{lockOK: true}
+	s := &Shipper{uploadCompacted: true, leaser: leaser}
+
+	proceed, acquired, err := s.lockCompacted(context.Background(), []*block.Meta{compactedMeta(id, 2)}, nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !proceed || !acquired {
+		t.Fatalf("expected proceed=true, acquired=true for a pending compacted block, got proceed=%v acquired=%v", proceed, acquired)
+	}
+	if leaser.lockCalls != 1 {
+		t.Fatalf("expected Lock to be called once, got %d calls", leaser.lockCalls)
+	}
+}
+
+func TestShipper_lockCompacted_AlreadyUploadedIsNotPending(t *testing.T) {
+	id := ulid.MustParse("01ARZ3NDEKTSV4RRFFQ69G5FAV")
+	leaser := &fakeLeaser{lockOK: true}
+	s := &Shipper{uploadCompacted: true, leaser: leaser}
+
+	hasUploaded := map[ulid.ULID]struct{}{id: {}}
+	proceed, acquired, err := s.lockCompacted(context.Background(), []*block.Meta{compactedMeta(id, 2)}, hasUploaded, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// This is the regression this test guards: without it, a routine Sync pass with
+	// nothing new pending used to still return acquired=true and unlock a lease it
+	// never took, potentially releasing one held by another shipper.
+	if !proceed || acquired {
+		t.Fatalf("expected proceed=true, acquired=false for an already-uploaded block, got proceed=%v acquired=%v", proceed, acquired)
+	}
+	if leaser.lockCalls != 0 {
+		t.Fatalf("expected Lock to never be called, got %d calls", leaser.lockCalls)
+	}
+}
+
+func TestWithUploadConcurrency_ClampsToAtLeastOne(t *testing.T) {
+	for _, tc := range []struct{ n, want int }{
+		{n: 0, want: 1},
+		{n: -5, want: 1},
+		{n: 1, want: 1},
+		{n: 8, want: 8},
+	} {
+		s := &Shipper{}
+		WithUploadConcurrency(tc.n)(s)
+		if s.uploadConcurrency != tc.want {
+			t.Errorf("WithUploadConcurrency(%d): got uploadConcurrency=%d, want %d", tc.n, s.uploadConcurrency, tc.want)
+		}
+	}
+}